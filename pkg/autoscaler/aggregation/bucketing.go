@@ -0,0 +1,210 @@
+/*
+Copyright 2019 The Knative Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TimedFloat64Buckets keeps buckets that have been collected at a certain time.
+type TimedFloat64Buckets struct {
+	bucketsMutex sync.RWMutex
+	buckets      map[time.Time]float64
+	// podBuckets tracks, for each time bucket, the per-pod contribution that
+	// was summed into buckets above. It lets callers break the aggregate back
+	// down by pod without needing a separate scraping pipeline.
+	podBuckets map[time.Time]map[string]float64
+	// exemplars holds, for each time bucket, at most one reservoir-sampled
+	// exemplar from the observations recorded into it.
+	exemplars map[time.Time]*exemplarReservoir
+
+	// subscribers, dirty and lastSent back Subscribe; they stay nil (and
+	// markDirtyLocked a no-op) until the first subscriber arrives.
+	subscribers map[uint64]chan BucketUpdate
+	nextSubID   uint64
+	dirty       map[time.Time]struct{}
+	lastSent    map[time.Time]float64
+	// flushRunning and flushStop track the flushLoop goroutine, which only
+	// runs while at least one subscriber is present so a TimedFloat64Buckets
+	// that every subscriber has left can still be garbage collected.
+	flushRunning bool
+	flushStop    chan struct{}
+
+	granularity time.Duration
+}
+
+// NewTimedFloat64Buckets generates a new TimedFloat64Buckets with the given
+// granularity.
+func NewTimedFloat64Buckets(granularity time.Duration) *TimedFloat64Buckets {
+	return &TimedFloat64Buckets{
+		buckets:     make(map[time.Time]float64),
+		podBuckets:  make(map[time.Time]map[string]float64),
+		exemplars:   make(map[time.Time]*exemplarReservoir),
+		granularity: granularity,
+	}
+}
+
+// Record adds a value for a given pod at a given time to the bucket.
+func (t *TimedFloat64Buckets) Record(time time.Time, name string, value float64) {
+	t.RecordWithExemplar(time, name, value, Exemplar{})
+}
+
+// recordLocked adds a value for a given pod at a given time to the bucket.
+// The caller must hold bucketsMutex for writing.
+func (t *TimedFloat64Buckets) recordLocked(bucketKey time.Time, name string, value float64) {
+	t.buckets[bucketKey] += value
+
+	pods := t.podBuckets[bucketKey]
+	if pods == nil {
+		pods = make(map[string]float64, 1)
+		t.podBuckets[bucketKey] = pods
+	}
+	pods[name] += value
+
+	t.markDirtyLocked(bucketKey)
+}
+
+// ForEachBucket calls each of the given functions for each bucket, passing
+// every function the bucket's full value.
+func (t *TimedFloat64Buckets) ForEachBucket(accs ...func(time.Time, float64)) bool {
+	t.bucketsMutex.RLock()
+	defer t.bucketsMutex.RUnlock()
+	if len(t.buckets) == 0 {
+		return false
+	}
+
+	for tm, b := range t.buckets {
+		for _, acc := range accs {
+			acc(tm, b)
+		}
+	}
+	return true
+}
+
+// PodValue is a single pod's aggregated contribution over a time window.
+type PodValue struct {
+	Name  string
+	Value float64
+}
+
+// mergeWindow sums the per-pod buckets whose time is not before
+// time.Now()-window into a single map keyed by pod name. Buckets timestamped
+// after time.Now() are included too.
+func (t *TimedFloat64Buckets) mergeWindow(window time.Duration) map[string]float64 {
+	cutoff := time.Now().Add(-window)
+
+	t.bucketsMutex.RLock()
+	defer t.bucketsMutex.RUnlock()
+
+	merged := make(map[string]float64)
+	for bucketTime, pods := range t.podBuckets {
+		if bucketTime.Before(cutoff) {
+			continue
+		}
+		for pod, v := range pods {
+			merged[pod] += v
+		}
+	}
+	return merged
+}
+
+// ForEachPod calls the given functions for each pod with a non-zero
+// contribution within the given window, and reports whether there was
+// anything to report.
+func (t *TimedFloat64Buckets) ForEachPod(window time.Duration, accs ...func(name string, value float64)) bool {
+	merged := t.mergeWindow(window)
+	if len(merged) == 0 {
+		return false
+	}
+
+	for pod, v := range merged {
+		for _, acc := range accs {
+			acc(pod, v)
+		}
+	}
+	return true
+}
+
+// podValueHeap is a min-heap of PodValue ordered by Value, which lets TopN
+// select the N largest contributions without sorting the full pod set.
+type podValueHeap []PodValue
+
+func (h podValueHeap) Len() int           { return len(h) }
+func (h podValueHeap) Less(i, j int) bool { return h[i].Value < h[j].Value }
+func (h podValueHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *podValueHeap) Push(x interface{}) {
+	*h = append(*h, x.(PodValue))
+}
+
+func (h *podValueHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	v := old[n-1]
+	*h = old[:n-1]
+	return v
+}
+
+// TopN returns the top N pods by their aggregated contribution over the given
+// window, ordered from largest to smallest. Fewer than N entries are returned
+// if fewer than N pods contributed within the window.
+func (t *TimedFloat64Buckets) TopN(window time.Duration, n int) []PodValue {
+	merged := t.mergeWindow(window)
+	if n <= 0 || len(merged) == 0 {
+		return nil
+	}
+
+	h := make(podValueHeap, 0, n)
+	for pod, v := range merged {
+		if len(h) < n {
+			heap.Push(&h, PodValue{Name: pod, Value: v})
+			continue
+		}
+		if v > h[0].Value {
+			h[0] = PodValue{Name: pod, Value: v}
+			heap.Fix(&h, 0)
+		}
+	}
+
+	sort.Sort(sort.Reverse(h))
+	return h
+}
+
+// RemoveOlderThan removes all buckets that are older than the given time.
+func (t *TimedFloat64Buckets) RemoveOlderThan(limit time.Time) {
+	t.bucketsMutex.Lock()
+	defer t.bucketsMutex.Unlock()
+	for k := range t.buckets {
+		if k.Before(limit) {
+			delete(t.buckets, k)
+			delete(t.podBuckets, k)
+			delete(t.exemplars, k)
+			delete(t.lastSent, k)
+			delete(t.dirty, k)
+		}
+	}
+}
+
+// isEmpty returns true if buckets are empty.
+func (t *TimedFloat64Buckets) isEmpty() bool {
+	t.bucketsMutex.RLock()
+	defer t.bucketsMutex.RUnlock()
+	return len(t.buckets) == 0
+}
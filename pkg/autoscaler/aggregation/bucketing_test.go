@@ -17,6 +17,7 @@ limitations under the License.
 package aggregation
 
 import (
+	"sort"
 	"testing"
 	"time"
 
@@ -210,3 +211,53 @@ func TestTimedFloat64BucketsRemoveOlderThan(t *testing.T) {
 		})
 	}
 }
+
+func TestTimedFloat64BucketsTopN(t *testing.T) {
+	granularity := time.Second
+	now := time.Now().Truncate(granularity)
+	buckets := NewTimedFloat64Buckets(granularity)
+
+	buckets.Record(now, "pod-1", 10.0)
+	buckets.Record(now, "pod-2", 5.0)
+	buckets.Record(now, "pod-3", 1.0)
+	buckets.Record(now.Add(-2*time.Minute), "pod-1", 100.0) // outside the 1m window queried below.
+
+	got := buckets.TopN(time.Minute, 2)
+	want := []PodValue{
+		{Name: "pod-1", Value: 10.0},
+		{Name: "pod-2", Value: 5.0},
+	}
+	if !cmp.Equal(want, got) {
+		t.Errorf("Unexpected TopN (-want +got): %v", cmp.Diff(want, got))
+	}
+
+	if got := buckets.TopN(time.Minute, 0); got != nil {
+		t.Errorf("TopN(_, 0) = %v, want nil", got)
+	}
+}
+
+func TestTimedFloat64BucketsForEachPod(t *testing.T) {
+	granularity := time.Second
+	now := time.Now().Truncate(granularity)
+	buckets := NewTimedFloat64Buckets(granularity)
+
+	if buckets.ForEachPod(time.Minute, func(string, float64) {}) {
+		t.Fatal("ForEachPod unexpectedly returned non-empty result")
+	}
+
+	buckets.Record(now, "pod-1", 10.0)
+	buckets.Record(now, "pod-2", 5.0)
+
+	var got []string
+	if !buckets.ForEachPod(time.Minute, func(name string, _ float64) {
+		got = append(got, name)
+	}) {
+		t.Fatal("ForEachPod unexpectedly returned empty result")
+	}
+
+	sort.Strings(got)
+	want := []string{"pod-1", "pod-2"}
+	if !cmp.Equal(want, got) {
+		t.Errorf("Unexpected pods (-want +got): %v", cmp.Diff(want, got))
+	}
+}
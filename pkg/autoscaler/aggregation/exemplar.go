@@ -0,0 +1,97 @@
+/*
+Copyright 2019 The Knative Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Exemplar carries the tracing context of a single observation, so that a
+// bucket that triggered a scaling decision can be traced back to one of the
+// requests responsible for it.
+type Exemplar struct {
+	TraceID   string
+	SpanID    string
+	Labels    map[string]string
+	Timestamp time.Time
+}
+
+// isZero reports whether e carries no tracing information, and so should
+// never be retained as a bucket's exemplar.
+func (e Exemplar) isZero() bool {
+	return e.TraceID == "" && e.SpanID == "" && len(e.Labels) == 0 && e.Timestamp.IsZero()
+}
+
+// exemplarReservoir implements k=1 reservoir sampling over the exemplars
+// offered for a single bucket, so every observation has equal probability of
+// being the one retained.
+type exemplarReservoir struct {
+	exemplar Exemplar
+	seen     int64
+}
+
+// offer considers ex for retention, replacing the currently retained
+// exemplar with probability 1/seen.
+func (r *exemplarReservoir) offer(ex Exemplar) {
+	r.seen++
+	if r.seen == 1 || rand.Intn(int(r.seen)) == 0 {
+		r.exemplar = ex
+	}
+}
+
+// RecordWithExemplar adds a value for a given pod at a given time to the
+// bucket, same as Record, and additionally offers ex as that bucket's
+// exemplar. A zero-value ex (as Record passes) is never retained.
+func (t *TimedFloat64Buckets) RecordWithExemplar(time time.Time, name string, value float64, ex Exemplar) {
+	bucketKey := time.Truncate(t.granularity)
+
+	t.bucketsMutex.Lock()
+	defer t.bucketsMutex.Unlock()
+	t.recordLocked(bucketKey, name, value)
+
+	if ex.isZero() {
+		return
+	}
+	r := t.exemplars[bucketKey]
+	if r == nil {
+		r = &exemplarReservoir{}
+		t.exemplars[bucketKey] = r
+	}
+	r.offer(ex)
+}
+
+// ForEachBucketWithExemplar calls the given functions for each bucket,
+// passing each the bucket's value and its retained exemplar, if any.
+func (t *TimedFloat64Buckets) ForEachBucketWithExemplar(accs ...func(time.Time, float64, Exemplar)) bool {
+	t.bucketsMutex.RLock()
+	defer t.bucketsMutex.RUnlock()
+	if len(t.buckets) == 0 {
+		return false
+	}
+
+	for tm, b := range t.buckets {
+		var ex Exemplar
+		if r := t.exemplars[tm]; r != nil {
+			ex = r.exemplar
+		}
+		for _, acc := range accs {
+			acc(tm, b, ex)
+		}
+	}
+	return true
+}
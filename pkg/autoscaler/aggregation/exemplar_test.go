@@ -0,0 +1,82 @@
+/*
+Copyright 2019 The Knative Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRecordDoesNotRetainAnExemplar(t *testing.T) {
+	granularity := time.Second
+	trunc1 := time.Now().Truncate(granularity)
+	buckets := NewTimedFloat64Buckets(granularity)
+
+	buckets.Record(trunc1, "pod", 1.0)
+
+	var got Exemplar
+	found := false
+	buckets.ForEachBucketWithExemplar(func(_ time.Time, _ float64, ex Exemplar) {
+		got = ex
+		found = true
+	})
+	if !found {
+		t.Fatal("ForEachBucketWithExemplar did not call back")
+	}
+	if !got.isZero() {
+		t.Errorf("Record() retained exemplar %+v, want zero value", got)
+	}
+}
+
+func TestRecordWithExemplarRetainsExemplar(t *testing.T) {
+	granularity := time.Second
+	trunc1 := time.Now().Truncate(granularity)
+	buckets := NewTimedFloat64Buckets(granularity)
+
+	want := Exemplar{TraceID: "trace-1", SpanID: "span-1", Timestamp: trunc1}
+	buckets.RecordWithExemplar(trunc1, "pod", 1.0, want)
+
+	var got Exemplar
+	buckets.ForEachBucketWithExemplar(func(_ time.Time, _ float64, ex Exemplar) {
+		got = ex
+	})
+	if !cmp.Equal(want, got) {
+		t.Errorf("Unexpected exemplar (-want +got): %v", cmp.Diff(want, got))
+	}
+}
+
+func TestExemplarReservoirRetainsExactlyOne(t *testing.T) {
+	r := &exemplarReservoir{}
+	for i := 0; i < 100; i++ {
+		r.offer(Exemplar{TraceID: string(rune('a' + i%26))})
+	}
+	if r.seen != 100 {
+		t.Errorf("seen = %d, want 100", r.seen)
+	}
+	if r.exemplar.isZero() {
+		t.Error("exemplar is zero after 100 offers, want a retained value")
+	}
+}
+
+func TestForEachBucketWithExemplarEmpty(t *testing.T) {
+	buckets := NewTimedFloat64Buckets(time.Second)
+	if buckets.ForEachBucketWithExemplar(func(time.Time, float64, Exemplar) {}) {
+		t.Error("ForEachBucketWithExemplar unexpectedly returned non-empty result")
+	}
+}
@@ -0,0 +1,397 @@
+/*
+Copyright 2019 The Knative Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// defaultHistogramSchema controls the resolution of newly created
+// Histograms: bucket boundaries are powers of 2^(2^-schema), so higher
+// schemas mean narrower (more accurate) buckets at the cost of more of them.
+const defaultHistogramSchema = 3
+
+// defaultZeroThreshold is the half-width of the zero bucket: observations
+// with an absolute value at or below this are counted as zero rather than
+// given their own exponential bucket.
+const defaultZeroThreshold = 1e-9
+
+// Span compresses a run of populated histogram buckets: Offset is the number
+// of empty buckets since the previous span (or since bucket 0 for the first
+// span) and Length is the number of consecutive populated buckets that
+// follow. This is the same encoding Prometheus native histograms use to keep
+// a sparse, mostly-empty bucket axis compact.
+type Span struct {
+	Offset int32
+	Length uint32
+}
+
+// HistogramSnapshot is the compact, wire-friendly encoding of a Histogram at
+// a point in time. PositiveBuckets and NegativeBuckets are deltas: each entry
+// is the difference in count from the previous populated bucket, so runs of
+// similar counts compress well.
+type HistogramSnapshot struct {
+	Schema        int32
+	ZeroThreshold float64
+	ZeroCount     int64
+
+	PositiveSpans   []Span
+	PositiveBuckets []int64
+
+	NegativeSpans   []Span
+	NegativeBuckets []int64
+
+	Count int64
+	Sum   float64
+}
+
+// Histogram is a sparse exponential histogram in the style of Prometheus
+// native histograms: only populated buckets consume memory, and resolution
+// is controlled by a single schema rather than fixed, hand-picked boundaries.
+// It supports Quantile queries directly, so it can stand in for a scalar
+// bucket value wherever percentile (not just average) aggregation is needed.
+type Histogram struct {
+	schema        int32
+	zeroThreshold float64
+	zeroCount     int64
+
+	// positive and negative hold observation counts keyed by bucket index.
+	// Only populated buckets are present; the Span/delta encoding used by
+	// Snapshot is derived from these on demand.
+	positive map[int32]int64
+	negative map[int32]int64
+
+	count int64
+	sum   float64
+}
+
+// newHistogram creates an empty Histogram at the default schema.
+func newHistogram() *Histogram {
+	return &Histogram{
+		schema:        defaultHistogramSchema,
+		zeroThreshold: defaultZeroThreshold,
+		positive:      make(map[int32]int64),
+		negative:      make(map[int32]int64),
+	}
+}
+
+// bucketIndex returns the index of the bucket that an observation of
+// magnitude abs (abs > 0) falls into for the given schema: bucket i covers
+// (base^i, base^(i+1)], where base = 2^(2^-schema). v falls in bucket
+// ceil(log_base(v)) - 1, since log_base(v) = log2(v) * 2^schema.
+func bucketIndex(schema int32, abs float64) int32 {
+	return int32(math.Ceil(math.Log2(abs)*math.Exp2(float64(schema)))) - 1
+}
+
+// base returns the bucket growth factor for the given schema.
+func base(schema int32) float64 {
+	return math.Exp2(math.Exp2(-float64(schema)))
+}
+
+// Observe folds a single value into the histogram.
+func (h *Histogram) Observe(value float64) {
+	h.count++
+	h.sum += value
+
+	abs := math.Abs(value)
+	if abs <= h.zeroThreshold {
+		h.zeroCount++
+		return
+	}
+
+	idx := bucketIndex(h.schema, abs)
+	if value > 0 {
+		h.positive[idx]++
+	} else {
+		h.negative[idx]++
+	}
+}
+
+// Count returns the number of observations folded into the histogram.
+func (h *Histogram) Count() int64 {
+	return h.count
+}
+
+// Quantile returns the q-quantile (0 <= q <= 1) of the observations folded
+// into the histogram so far, linearly interpolating within the bucket that
+// contains it.
+func (h *Histogram) Quantile(q float64) float64 {
+	if h.count == 0 {
+		return 0
+	}
+	target := q * float64(h.count)
+	b := base(h.schema)
+
+	var cumulative float64
+	for _, idx := range sortedKeys(h.negative, true /* descending */) {
+		c := float64(h.negative[idx])
+		if cumulative+c >= target {
+			lower, upper := -math.Pow(b, float64(idx+1)), -math.Pow(b, float64(idx))
+			return lower + (target-cumulative)/c*(upper-lower)
+		}
+		cumulative += c
+	}
+
+	if h.zeroCount > 0 && cumulative+float64(h.zeroCount) >= target {
+		return 0
+	}
+	cumulative += float64(h.zeroCount)
+
+	posIdx := sortedKeys(h.positive, false /* ascending */)
+	for _, idx := range posIdx {
+		c := float64(h.positive[idx])
+		if cumulative+c >= target {
+			lower, upper := math.Pow(b, float64(idx)), math.Pow(b, float64(idx+1))
+			return lower + (target-cumulative)/c*(upper-lower)
+		}
+		cumulative += c
+	}
+
+	if len(posIdx) > 0 {
+		return math.Pow(b, float64(posIdx[len(posIdx)-1]+1))
+	}
+	return 0
+}
+
+// merge folds other's observations into h, downsampling other first if its
+// schema is finer than h's. Once both sides use the same schema, merging is
+// just count-additive per bucket.
+func (h *Histogram) merge(other *Histogram) {
+	if other.count == 0 {
+		return
+	}
+
+	schema := h.schema
+	if other.schema < schema {
+		schema = other.schema
+	}
+	h.downsampleTo(schema)
+	other = other.downsampled(schema)
+
+	h.zeroCount += other.zeroCount
+	for idx, c := range other.positive {
+		h.positive[idx] += c
+	}
+	for idx, c := range other.negative {
+		h.negative[idx] += c
+	}
+	h.count += other.count
+	h.sum += other.sum
+}
+
+// downsampled returns a copy of h re-indexed to the given, coarser schema.
+func (h *Histogram) downsampled(schema int32) *Histogram {
+	if schema == h.schema {
+		return h
+	}
+	out := &Histogram{
+		schema:        schema,
+		zeroThreshold: h.zeroThreshold,
+		zeroCount:     h.zeroCount,
+		positive:      make(map[int32]int64, len(h.positive)),
+		negative:      make(map[int32]int64, len(h.negative)),
+		count:         h.count,
+		sum:           h.sum,
+	}
+	for idx, c := range h.positive {
+		out.positive[downsampleIndex(idx, h.schema, schema)] += c
+	}
+	for idx, c := range h.negative {
+		out.negative[downsampleIndex(idx, h.schema, schema)] += c
+	}
+	return out
+}
+
+// downsampleTo re-indexes h in place to the given, coarser schema.
+func (h *Histogram) downsampleTo(schema int32) {
+	if schema == h.schema {
+		return
+	}
+	*h = *h.downsampled(schema)
+}
+
+// downsampleIndex maps a bucket index from a finer schema to the bucket it
+// falls into at a coarser schema. Each step down in schema halves the number
+// of buckets covering a given value range.
+func downsampleIndex(idx, from, to int32) int32 {
+	for from > to {
+		idx = int32(math.Floor(float64(idx) / 2))
+		from--
+	}
+	return idx
+}
+
+// Snapshot returns the compact Span/delta encoding of the histogram's
+// current state, suitable for serialization.
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	posSpans, posDeltas := spansFromCounts(sortedKeys(h.positive, false), h.positive)
+	negSpans, negDeltas := spansFromCounts(sortedKeys(h.negative, false), h.negative)
+	return HistogramSnapshot{
+		Schema:          h.schema,
+		ZeroThreshold:   h.zeroThreshold,
+		ZeroCount:       h.zeroCount,
+		PositiveSpans:   posSpans,
+		PositiveBuckets: posDeltas,
+		NegativeSpans:   negSpans,
+		NegativeBuckets: negDeltas,
+		Count:           h.count,
+		Sum:             h.sum,
+	}
+}
+
+// sortedKeys returns the keys of buckets in ascending (or descending) order.
+func sortedKeys(buckets map[int32]int64, descending bool) []int32 {
+	keys := make([]int32, 0, len(buckets))
+	for idx := range buckets {
+		keys = append(keys, idx)
+	}
+	if descending {
+		sort.Slice(keys, func(i, j int) bool { return keys[i] > keys[j] })
+	} else {
+		sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	}
+	return keys
+}
+
+// spansFromCounts encodes the given populated, ascending bucket indices as
+// Prometheus-style spans and per-bucket count deltas.
+func spansFromCounts(indices []int32, counts map[int32]int64) ([]Span, []int64) {
+	if len(indices) == 0 {
+		return nil, nil
+	}
+
+	spans := []Span{{Offset: indices[0]}}
+	deltas := make([]int64, 0, len(indices))
+
+	var prevIdx int32
+	var prevCount int64
+	for i, idx := range indices {
+		if i > 0 && idx != prevIdx+1 {
+			spans = append(spans, Span{Offset: idx - prevIdx - 1})
+		}
+		spans[len(spans)-1].Length++
+
+		count := counts[idx]
+		deltas = append(deltas, count-prevCount)
+		prevCount = count
+		prevIdx = idx
+	}
+	return spans, deltas
+}
+
+// TimedHistogramBuckets keeps, for each time bucket, a Histogram of the
+// values recorded in it -- the histogram-valued sibling of
+// TimedFloat64Buckets, for percentile rather than average aggregation.
+type TimedHistogramBuckets struct {
+	bucketsMutex sync.RWMutex
+	buckets      map[time.Time]*Histogram
+	granularity  time.Duration
+}
+
+// NewTimedHistogramBuckets generates a new TimedHistogramBuckets with the
+// given granularity.
+func NewTimedHistogramBuckets(granularity time.Duration) *TimedHistogramBuckets {
+	return &TimedHistogramBuckets{
+		buckets:     make(map[time.Time]*Histogram),
+		granularity: granularity,
+	}
+}
+
+// Record adds a value for a given pod at a given time to the bucket.
+func (t *TimedHistogramBuckets) Record(time time.Time, name string, value float64) {
+	bucketKey := time.Truncate(t.granularity)
+
+	t.bucketsMutex.Lock()
+	defer t.bucketsMutex.Unlock()
+	h := t.buckets[bucketKey]
+	if h == nil {
+		h = newHistogram()
+		t.buckets[bucketKey] = h
+	}
+	h.Observe(value)
+}
+
+// ForEachBucket calls the given functions for each bucket, passing each the
+// bucket's histogram.
+func (t *TimedHistogramBuckets) ForEachBucket(accs ...func(time.Time, *Histogram)) bool {
+	t.bucketsMutex.RLock()
+	defer t.bucketsMutex.RUnlock()
+	if len(t.buckets) == 0 {
+		return false
+	}
+
+	for tm, h := range t.buckets {
+		for _, acc := range accs {
+			acc(tm, h)
+		}
+	}
+	return true
+}
+
+// Quantile returns the q-quantile (0 <= q <= 1) of the bucket that the given
+// time falls into, or 0 if there is no such bucket.
+func (t *TimedHistogramBuckets) Quantile(time time.Time, q float64) float64 {
+	bucketKey := time.Truncate(t.granularity)
+
+	t.bucketsMutex.RLock()
+	defer t.bucketsMutex.RUnlock()
+	h := t.buckets[bucketKey]
+	if h == nil {
+		return 0
+	}
+	return h.Quantile(q)
+}
+
+// WindowQuantile merges every bucket whose time is not before
+// time.Now()-window (buckets timestamped after time.Now() included) into a
+// single histogram and returns its q-quantile.
+func (t *TimedHistogramBuckets) WindowQuantile(window time.Duration, q float64) float64 {
+	cutoff := time.Now().Add(-window)
+
+	t.bucketsMutex.RLock()
+	defer t.bucketsMutex.RUnlock()
+
+	merged := newHistogram()
+	for bucketTime, h := range t.buckets {
+		if bucketTime.Before(cutoff) {
+			continue
+		}
+		merged.merge(h)
+	}
+	return merged.Quantile(q)
+}
+
+// RemoveOlderThan removes all buckets that are older than the given time.
+func (t *TimedHistogramBuckets) RemoveOlderThan(limit time.Time) {
+	t.bucketsMutex.Lock()
+	defer t.bucketsMutex.Unlock()
+	for k := range t.buckets {
+		if k.Before(limit) {
+			delete(t.buckets, k)
+		}
+	}
+}
+
+// isEmpty returns true if buckets are empty.
+func (t *TimedHistogramBuckets) isEmpty() bool {
+	t.bucketsMutex.RLock()
+	defer t.bucketsMutex.RUnlock()
+	return len(t.buckets) == 0
+}
@@ -0,0 +1,147 @@
+/*
+Copyright 2019 The Knative Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"sync"
+	"time"
+)
+
+// WindowSpec describes one of the rolling windows a MultiWindowBuckets
+// instance maintains: `Window` is how far back the window reaches and
+// `Granularity` is the bucket size used to record into it.
+type WindowSpec struct {
+	Window      time.Duration
+	Granularity time.Duration
+}
+
+// MultiWindowBuckets fans a single stream of Record calls into several
+// TimedFloat64Buckets, one per requested (window, granularity) pair, so that
+// e.g. a short panic window and a longer stable window can share one
+// recording path instead of being recorded into twice.
+type MultiWindowBuckets struct {
+	bucketsMutex sync.RWMutex
+	// windows holds one TimedFloat64Buckets per configured window, keyed by
+	// the window duration passed to NewMultiWindowBuckets.
+	windows map[time.Duration]*TimedFloat64Buckets
+	// granularities mirrors windows, recording each window's own bucket size
+	// so eviction can be rate-limited to once per granularity tick.
+	granularities map[time.Duration]time.Duration
+	// nextEvict tracks, per window, the next time RemoveOlderThan is allowed
+	// to run again.
+	nextEvict map[time.Duration]time.Time
+}
+
+// NewMultiWindowBuckets creates a new MultiWindowBuckets that records into one
+// TimedFloat64Buckets per given WindowSpec.
+func NewMultiWindowBuckets(specs ...WindowSpec) *MultiWindowBuckets {
+	windows := make(map[time.Duration]*TimedFloat64Buckets, len(specs))
+	granularities := make(map[time.Duration]time.Duration, len(specs))
+	for _, s := range specs {
+		windows[s.Window] = NewTimedFloat64Buckets(s.Granularity)
+		granularities[s.Window] = s.Granularity
+	}
+	return &MultiWindowBuckets{
+		windows:       windows,
+		granularities: granularities,
+		nextEvict:     make(map[time.Duration]time.Time, len(specs)),
+	}
+}
+
+// Record adds a value for a given pod at a given time to every configured
+// window. Eviction of buckets that have fallen out of a window's horizon is
+// rate-limited to once per that window's granularity, rather than scanning
+// every window on every Record call.
+func (m *MultiWindowBuckets) Record(now time.Time, name string, value float64) {
+	m.bucketsMutex.Lock()
+	defer m.bucketsMutex.Unlock()
+
+	for window, buckets := range m.windows {
+		buckets.Record(now, name, value)
+
+		if due, ok := m.nextEvict[window]; ok && now.Before(due) {
+			continue
+		}
+		buckets.RemoveOlderThan(now.Add(-window))
+		m.nextEvict[window] = now.Add(m.granularities[window])
+	}
+}
+
+// Sum returns the sum of the values of buckets whose time is not before
+// time.Now()-window; buckets timestamped after time.Now() are included too.
+// Buckets are filtered to that range at query time, so a call made between
+// eviction ticks (see Record) never double-counts history that has aged out
+// of the window but hasn't been swept yet.
+func (m *MultiWindowBuckets) Sum(window time.Duration) float64 {
+	buckets := m.bucketsFor(window)
+	if buckets == nil {
+		return 0
+	}
+
+	cutoff := time.Now().Add(-window)
+	var sum float64
+	buckets.ForEachBucket(func(bucketTime time.Time, b float64) {
+		if bucketTime.Before(cutoff) {
+			return
+		}
+		sum += b
+	})
+	return sum
+}
+
+// Average returns the average of the values of buckets whose time is not
+// before time.Now()-window, filtered the same way Sum is.
+func (m *MultiWindowBuckets) Average(window time.Duration) float64 {
+	buckets := m.bucketsFor(window)
+	if buckets == nil {
+		return 0
+	}
+
+	cutoff := time.Now().Add(-window)
+	var sum float64
+	var count int
+	buckets.ForEachBucket(func(bucketTime time.Time, b float64) {
+		if bucketTime.Before(cutoff) {
+			return
+		}
+		sum += b
+		count++
+	})
+	if count == 0 {
+		return 0
+	}
+	return sum / float64(count)
+}
+
+// ForEachBucket calls each of the given functions for each bucket of the
+// given window, passing every function the bucket's full value.
+// It reports false if the window is unknown or has no buckets.
+func (m *MultiWindowBuckets) ForEachBucket(window time.Duration, accs ...func(time.Time, float64)) bool {
+	buckets := m.bucketsFor(window)
+	if buckets == nil {
+		return false
+	}
+	return buckets.ForEachBucket(accs...)
+}
+
+// bucketsFor returns the TimedFloat64Buckets backing the given window, or nil
+// if the window was not configured at construction time.
+func (m *MultiWindowBuckets) bucketsFor(window time.Duration) *TimedFloat64Buckets {
+	m.bucketsMutex.RLock()
+	defer m.bucketsMutex.RUnlock()
+	return m.windows[window]
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2019 The Knative Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMultiWindowBucketsSumAndAverage(t *testing.T) {
+	pod := "pod"
+	panicWindow := 2 * time.Second
+	stableWindow := 10 * time.Second
+	now := time.Now().Truncate(time.Second)
+
+	buckets := NewMultiWindowBuckets(
+		WindowSpec{Window: panicWindow, Granularity: time.Second},
+		WindowSpec{Window: stableWindow, Granularity: time.Second},
+	)
+
+	buckets.Record(now, pod, 10.0)
+	buckets.Record(now.Add(1*time.Second), pod, 20.0)
+	buckets.Record(now.Add(4*time.Second), pod, 30.0)
+
+	if got, want := buckets.Sum(stableWindow), 60.0; got != want {
+		t.Errorf("Sum(stableWindow) = %v, want %v", got, want)
+	}
+	if got, want := buckets.Average(stableWindow), 20.0; got != want {
+		t.Errorf("Average(stableWindow) = %v, want %v", got, want)
+	}
+
+	if got := buckets.Sum(time.Hour); got != 0 {
+		t.Errorf("Sum(unconfigured window) = %v, want 0", got)
+	}
+	if got := buckets.Average(time.Hour); got != 0 {
+		t.Errorf("Average(unconfigured window) = %v, want 0", got)
+	}
+}
+
+func TestMultiWindowBucketsForEachBucket(t *testing.T) {
+	pod := "pod"
+	window := 10 * time.Second
+	now := time.Now().Truncate(time.Second)
+
+	buckets := NewMultiWindowBuckets(WindowSpec{Window: window, Granularity: time.Second})
+
+	if buckets.ForEachBucket(window, func(time.Time, float64) {}) {
+		t.Fatal("ForEachBucket unexpectedly returned non-empty result for an empty set of buckets")
+	}
+
+	buckets.Record(now, pod, 1.0)
+
+	count := 0
+	if !buckets.ForEachBucket(window, func(time.Time, float64) { count++ }) {
+		t.Fatal("ForEachBucket unexpectedly returned empty result")
+	}
+	if count != 1 {
+		t.Errorf("ForEachBucket called back %d times, want 1", count)
+	}
+
+	if buckets.ForEachBucket(time.Hour, func(time.Time, float64) {}) {
+		t.Error("ForEachBucket(unconfigured window) unexpectedly returned non-empty result")
+	}
+}
+
+func TestMultiWindowBucketsSumFiltersStaleBucketsAtQueryTime(t *testing.T) {
+	pod := "pod"
+	window := time.Second
+	granularity := time.Second
+	now := time.Now()
+
+	buckets := NewMultiWindowBuckets(WindowSpec{Window: window, Granularity: granularity})
+
+	// Record directly into the underlying TimedFloat64Buckets, bypassing
+	// MultiWindowBuckets.Record's rate-limited eviction entirely, so this
+	// isolates Sum/Average's own query-time window filtering from whether
+	// eviction has caught up yet.
+	underlying := buckets.bucketsFor(window)
+	underlying.Record(now.Add(-time.Hour), pod, 100.0)
+	underlying.Record(now, pod, 1.0)
+
+	if got, want := buckets.Sum(window), 1.0; got != want {
+		t.Errorf("Sum(window) = %v, want %v; a stale, un-evicted bucket leaked into the sum", got, want)
+	}
+	if got, want := buckets.Average(window), 1.0; got != want {
+		t.Errorf("Average(window) = %v, want %v", got, want)
+	}
+}
+
+func TestMultiWindowBucketsEvictsPerWindowHorizon(t *testing.T) {
+	pod := "pod"
+	window := 2 * time.Second
+	granularity := time.Second
+	now := time.Now().Truncate(granularity)
+
+	buckets := NewMultiWindowBuckets(WindowSpec{Window: window, Granularity: granularity})
+
+	buckets.Record(now, pod, 1.0)
+	// Record far enough past the window's horizon, and past its own
+	// granularity tick, that the next Record call is due to evict it.
+	later := now.Add(window + granularity + granularity)
+	buckets.Record(later, pod, 1.0)
+
+	got := buckets.Sum(window)
+	want := 1.0 // only the most recent sample should remain within the window.
+	if got != want {
+		t.Errorf("Sum(window) = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2019 The Knative Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"context"
+	"time"
+)
+
+// BucketUpdate describes a change to a single bucket's aggregated value,
+// delivered to Subscribe's channel.
+type BucketUpdate struct {
+	Time  time.Time
+	Value float64
+	Delta float64
+}
+
+// subscriberBacklog bounds how many undelivered updates a subscriber channel
+// may queue before it is considered slow and closed, rather than growing
+// memory without bound.
+const subscriberBacklog = 32
+
+// Subscribe returns a channel of BucketUpdate events, one per bucket whose
+// value changed since the last flush tick (every granularity interval), so
+// that reconcilers can react to aggregation changes instead of polling and
+// diffing the whole bucket map on a fixed timer. The channel is closed once
+// ctx is done, or earlier if the subscriber falls too far behind.
+func (t *TimedFloat64Buckets) Subscribe(ctx context.Context) <-chan BucketUpdate {
+	ch := make(chan BucketUpdate, subscriberBacklog)
+
+	t.bucketsMutex.Lock()
+	if t.subscribers == nil {
+		t.subscribers = make(map[uint64]chan BucketUpdate)
+		t.dirty = make(map[time.Time]struct{})
+		t.lastSent = make(map[time.Time]float64)
+	}
+	id := t.nextSubID
+	t.nextSubID++
+	t.subscribers[id] = ch
+	if !t.flushRunning {
+		t.flushRunning = true
+		t.flushStop = make(chan struct{})
+		go t.flushLoop(t.flushStop)
+	}
+	t.bucketsMutex.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		t.unsubscribe(id)
+	}()
+
+	return ch
+}
+
+// markDirtyLocked records that bucketKey's value changed. The caller must
+// hold bucketsMutex for writing. It is a no-op until the first subscriber
+// arrives, so Record pays no cost when nobody is listening.
+func (t *TimedFloat64Buckets) markDirtyLocked(bucketKey time.Time) {
+	if len(t.subscribers) == 0 {
+		return
+	}
+	t.dirty[bucketKey] = struct{}{}
+}
+
+// unsubscribe removes and closes the channel for the given subscriber, if
+// still present.
+func (t *TimedFloat64Buckets) unsubscribe(id uint64) {
+	t.bucketsMutex.Lock()
+	defer t.bucketsMutex.Unlock()
+	t.unsubscribeLocked(id)
+}
+
+// unsubscribeLocked removes and closes the channel for the given subscriber,
+// if still present, and stops the flush loop once the last subscriber is
+// gone so an unwatched TimedFloat64Buckets doesn't tick (and keep itself
+// alive) forever. The caller must hold bucketsMutex for writing.
+//
+// Closing ch only ever happens here, under bucketsMutex, which is the same
+// lock flush holds while sending to ch -- that's what keeps a slow or
+// cancelled subscriber's channel close from racing a concurrent send.
+func (t *TimedFloat64Buckets) unsubscribeLocked(id uint64) {
+	ch, ok := t.subscribers[id]
+	if !ok {
+		return
+	}
+	delete(t.subscribers, id)
+	close(ch)
+
+	if len(t.subscribers) == 0 && t.flushRunning {
+		close(t.flushStop)
+		t.flushRunning = false
+	}
+}
+
+// flushLoop runs until stop is closed, coalescing dirty buckets into at most
+// one update per bucket per tick. A fresh flushLoop is started the next time
+// a subscriber arrives after the last one leaves.
+func (t *TimedFloat64Buckets) flushLoop(stop <-chan struct{}) {
+	ticker := time.NewTicker(t.granularity)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.flush()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// flush drains the dirty-bucket set and delivers one BucketUpdate per dirty
+// bucket to every current subscriber, dropping any subscriber whose channel
+// is full when an update is sent to it. The sends happen while holding
+// bucketsMutex for writing, the same lock unsubscribeLocked holds while
+// closing a subscriber's channel, so a send here can never race a concurrent
+// close triggered by the subscriber's context being cancelled.
+func (t *TimedFloat64Buckets) flush() {
+	t.bucketsMutex.Lock()
+	defer t.bucketsMutex.Unlock()
+	if len(t.dirty) == 0 {
+		return
+	}
+
+	updates := make([]BucketUpdate, 0, len(t.dirty))
+	for bucketKey := range t.dirty {
+		value, ok := t.buckets[bucketKey]
+		if !ok {
+			// No bucket for this key; RemoveOlderThan drops the dirty
+			// mark along with the bucket, so this is only a guard.
+			// Nothing to report.
+			continue
+		}
+		delta := value - t.lastSent[bucketKey]
+		t.lastSent[bucketKey] = value
+		updates = append(updates, BucketUpdate{Time: bucketKey, Value: value, Delta: delta})
+	}
+	t.dirty = make(map[time.Time]struct{})
+
+	for id, ch := range t.subscribers {
+	sendLoop:
+		for _, u := range updates {
+			select {
+			case ch <- u:
+			default:
+				t.unsubscribeLocked(id)
+				break sendLoop
+			}
+		}
+	}
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2019 The Knative Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSubscribeDeliversCoalescedUpdate(t *testing.T) {
+	granularity := 10 * time.Millisecond
+	now := time.Now().Truncate(granularity)
+	buckets := NewTimedFloat64Buckets(granularity)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := buckets.Subscribe(ctx)
+
+	// Multiple Record calls within one granularity interval should coalesce
+	// into a single update once the flush tick fires.
+	buckets.Record(now, "pod", 1.0)
+	buckets.Record(now, "pod", 2.0)
+
+	select {
+	case u := <-ch:
+		if u.Time != now || u.Value != 3.0 || u.Delta != 3.0 {
+			t.Errorf("got update %+v, want {Time: %v, Value: 3, Delta: 3}", u, now)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for BucketUpdate")
+	}
+
+	select {
+	case u, ok := <-ch:
+		if ok {
+			t.Errorf("got unexpected second update %+v", u)
+		}
+	case <-time.After(50 * time.Millisecond):
+		// No further update in this tick, as expected.
+	}
+}
+
+func TestSubscribeClosesChannelOnContextDone(t *testing.T) {
+	buckets := NewTimedFloat64Buckets(10 * time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := buckets.Subscribe(ctx)
+	cancel()
+
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Error("channel delivered a value instead of closing")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for channel to close after ctx.Done()")
+	}
+}
+
+func TestRecordDoesNotDirtyBucketsWithoutSubscribers(t *testing.T) {
+	granularity := 10 * time.Millisecond
+	now := time.Now().Truncate(granularity)
+	buckets := NewTimedFloat64Buckets(granularity)
+
+	buckets.Record(now, "pod", 1.0)
+
+	buckets.bucketsMutex.RLock()
+	dirty := len(buckets.dirty)
+	buckets.bucketsMutex.RUnlock()
+	if dirty != 0 {
+		t.Errorf("len(dirty) = %d, want 0 when there are no subscribers", dirty)
+	}
+}
+
+func TestRemoveOlderThanClearsDirtyBeforeFlush(t *testing.T) {
+	granularity := 10 * time.Millisecond
+	now := time.Now().Truncate(granularity)
+	buckets := NewTimedFloat64Buckets(granularity)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := buckets.Subscribe(ctx)
+
+	buckets.Record(now, "pod", 1.0)
+	buckets.RemoveOlderThan(now.Add(time.Hour)) // evict everything, including the dirty entry.
+
+	select {
+	case u := <-ch:
+		t.Fatalf("got phantom update %+v for a bucket evicted before its flush tick", u)
+	case <-time.After(100 * time.Millisecond):
+		// No update delivered for the evicted bucket, as expected.
+	}
+}
+
+// TestSubscribeCancelRacesFlush subscribes and cancels in a tight loop on
+// several goroutines while Record/RemoveOlderThan keep the flush loop busy
+// sending updates, reproducing the close-while-sending race between
+// flush's per-subscriber send and ctx.Done()'s unsubscribe. Run with -race.
+func TestSubscribeCancelRacesFlush(t *testing.T) {
+	buckets := NewTimedFloat64Buckets(time.Millisecond)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				now := time.Now()
+				buckets.Record(now, "pod", 1.0)
+				buckets.RemoveOlderThan(now.Add(-time.Second))
+			}
+		}
+	}()
+
+	const subscribers = 8
+	for i := 0; i < subscribers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				ctx, cancel := context.WithCancel(context.Background())
+				ch := buckets.Subscribe(ctx)
+				cancel()
+				for range ch {
+					// Drain until unsubscribe closes it.
+				}
+			}
+		}()
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+}